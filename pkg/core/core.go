@@ -12,20 +12,69 @@ import (
 	"go.uber.org/zap"
 )
 
+// ProxyFactory builds a Proxy dedicated to a single app. Core calls it once
+// per app id instead of sharing one Proxy across every app, since a
+// Dockerized app lives in its own network namespace and its proxy needs
+// per-app namespace/veth info that a shared instance has nowhere to keep.
+type ProxyFactory func(logger *zap.Logger) Proxy
+
 type Core struct {
-	logger       *zap.Logger
-	id           utils.AutoInc
-	apps         sync.Map
-	hook         Hooks
-	proxy        Proxy
-	proxyStarted bool
+	logger   *zap.Logger
+	id       utils.AutoInc
+	apps     sync.Map
+	hook     Hooks
+	newProxy ProxyFactory
+
+	// proxies holds the live proxy entry for every currently hooked app,
+	// keyed by app id - a distinct Proxy instance per app rather than one
+	// shared Proxy, so that a second Dockerized app in a different network
+	// namespace gets its own bind address, DNS resolver and teardown
+	// instead of cross-wiring with the first.
+	proxies sync.Map // map[uint64]proxyEntry
 }
 
-func New(logger *zap.Logger, hook Hooks, proxy Proxy) *Core {
+func New(logger *zap.Logger, hook Hooks, newProxy ProxyFactory) *Core {
 	return &Core{
-		logger: logger,
-		hook:   hook,
-		proxy:  proxy,
+		logger:   logger,
+		hook:     hook,
+		newProxy: newProxy,
+	}
+}
+
+// proxyEntry pairs the Proxy dedicated to one app with the bind address it
+// returned from StartProxy/StartSocks5, so a second Hook call for the same
+// app (or a teardown in Run) never has to ask the Proxy for it again.
+type proxyEntry struct {
+	proxy Proxy
+	addr  string
+}
+
+// getOrStartProxy returns the bind address of the Proxy already running for
+// id, or builds a fresh, dedicated Proxy via start and stores it keyed by
+// id. start is called only when no Proxy is stored for id; a failed start
+// stores nothing, so a later call for the same id calls start again.
+func (c *Core) getOrStartProxy(id uint64, start func(Proxy) (string, error)) (string, error) {
+	if e, ok := c.proxies.Load(id); ok {
+		return e.(proxyEntry).addr, nil
+	}
+
+	p := c.newProxy(c.logger)
+	addr, err := start(p)
+	if err != nil {
+		return "", err
+	}
+	c.proxies.Store(id, proxyEntry{proxy: p, addr: addr})
+	return addr, nil
+}
+
+// stopProxy tears down and forgets the Proxy running for id, if any.
+func (c *Core) stopProxy(ctx context.Context, id uint64) {
+	e, ok := c.proxies.LoadAndDelete(id)
+	if !ok {
+		return
+	}
+	if err := e.(proxyEntry).proxy.StopProxy(ctx); err != nil {
+		c.logger.Error("failed to stop proxy", zap.Uint64("appId", id), zap.Error(err))
 	}
 }
 
@@ -66,6 +115,28 @@ func (c *Core) Hook(ctx context.Context, id uint64, opts models.HookOptions) err
 		return hookErr
 	}
 
+	_, alreadyRunning := c.proxies.Load(id)
+
+	// SOCKS5 mode skips eBPF entirely: the app is pointed at our listener
+	// via HTTP_PROXY/ALL_PROXY instead of being redirected by the hook, so
+	// there's nothing to load into the kernel and no shared proxy IP to
+	// push down.
+	if opts.Mode == models.ModeSocks5 {
+		addr, err := c.getOrStartProxy(id, func(p Proxy) (string, error) {
+			return p.StartSocks5(ctx, ProxyOptions{
+				AppID:       id,
+				NetNsPath:   a.NetworkNamespace(),
+				UpstreamDNS: opts.UpstreamDNS,
+			})
+		})
+		if err != nil {
+			c.logger.Error("Failed to start socks5 proxy", zap.Error(err))
+			return hookErr
+		}
+		c.logger.Info("app is ready to be pointed at the socks5 proxy", zap.Uint64("appId", id), zap.String("proxyAddr", addr))
+		return nil
+	}
+
 	isDocker := false
 	appKind := a.Kind(ctx)
 	//check if the app is docker/docker-compose or native
@@ -73,38 +144,41 @@ func (c *Core) Hook(ctx context.Context, id uint64, opts models.HookOptions) err
 		isDocker = true
 	}
 
+	// each app gets its own Proxy, bound to its own address: a containerized
+	// app lives in its own network namespace, so the IP:port pushed into
+	// eBPF for one app is meaningless to another, and a second record
+	// session in the same keploy invocation would otherwise cross-wire the
+	// two by sharing a single Proxy's state.
+	addr, err := c.getOrStartProxy(id, func(p Proxy) (string, error) {
+		return p.StartProxy(ctx, ProxyOptions{
+			AppID:       id,
+			DnsIPv4Addr: a.KeployIPv4Addr(),
+			NetNsPath:   a.NetworkNamespace(),
+			UpstreamDNS: opts.UpstreamDNS,
+			//DnsIPv6Addr: ""
+		})
+	})
+	if err != nil {
+		c.logger.Error("Failed to start proxy", zap.Error(err))
+		return hookErr
+	}
+
 	// TODO: ensure right values are passed to the hook
 	//load hooks
 	err = c.hook.Load(ctx, id, HookCfg{
 		AppID:      id,
 		Pid:        0,
 		IsDocker:   isDocker,
-		KeployIPV4: a.KeployIPv4Addr(),
+		KeployIPV4: addr,
 	})
 	if err != nil {
 		c.logger.Error("Failed to load hooks", zap.Error(err))
+		if !alreadyRunning {
+			c.stopProxy(ctx, id)
+		}
 		return hookErr
 	}
 
-	if c.proxyStarted {
-		c.logger.Debug("Proxy already started")
-		return nil
-	}
-
-	// TODO: Hooks can be loaded multiple times but proxy should be started only once
-	// if there is another containerized app, then we need to pass new (ip:port) of proxy to the eBPF
-	// as the network namespace is different for each container and so is the keploy/proxy IP to communicate with the app.
-	//start proxy
-	err = c.proxy.StartProxy(ctx, ProxyOptions{
-		DnsIPv4Addr: a.KeployIPv4Addr(),
-		//DnsIPv6Addr: ""
-	})
-	if err != nil {
-		c.logger.Error("Failed to start proxy", zap.Error(err))
-		return hookErr
-	}
-
-	c.proxyStarted = true
 	return nil
 }
 
@@ -132,5 +206,11 @@ func (c *Core) Run(ctx context.Context, id uint64, opts models.RunOptions) model
 		}
 	}(inodeChan)
 
+	// the Proxy started for this app in Hook is only valid for its
+	// lifetime; tear it down once the app exits so a later app reusing the
+	// same id (or racing a different one) can't be handed a stale address
+	// or have its traffic cross-wired with this one's.
+	defer c.stopProxy(ctx, id)
+
 	return a.Run(ctx, inodeChan, app.Options{DockerDelay: opts.DockerDelay})
 }
@@ -0,0 +1,423 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dnsQuestion is the minimal subset of a DNS wire-format question section
+// the TTL cache keys on. The cache stores whatever bytes the upstream
+// returned, not a decoded record; answers are only walked by minDNSTTL to
+// find their TTLs.
+type dnsQuestion struct {
+	qname string
+	qtype uint16
+}
+
+type dnsCacheEntry struct {
+	resp      []byte
+	expiresAt time.Time
+}
+
+// UpstreamDNS resolves app DNS queries over UDP, DNS-over-TLS or
+// DNS-over-HTTPS depending on rawURL's scheme:
+//
+//	udp://1.1.1.1:53
+//	tls://1.1.1.1:853
+//	https://cloudflare-dns.com/dns-query
+//
+// so that recording still works on networks that block plain port 53 or
+// require encrypted DNS. Resolve results are cached in-memory by
+// (qname, qtype) until the upstream TTL expires.
+type UpstreamDNS struct {
+	scheme string
+	addr   string // host:port for udp/tls, full URL for https
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[dnsQuestion]dnsCacheEntry
+}
+
+// NewUpstreamDNS parses rawURL and builds a resolver for it. It returns an
+// error for an unsupported or malformed scheme.
+func NewUpstreamDNS(rawURL string) (*UpstreamDNS, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse upstream dns url %q: %w", rawURL, err)
+	}
+
+	r := &UpstreamDNS{
+		scheme: u.Scheme,
+		cache:  make(map[dnsQuestion]dnsCacheEntry),
+	}
+
+	switch u.Scheme {
+	case "udp":
+		r.addr = u.Host
+	case "tls":
+		r.addr = u.Host
+	case "https":
+		r.addr = u.String()
+		r.client = &http.Client{Timeout: 5 * time.Second}
+	default:
+		return nil, fmt.Errorf("unsupported upstream dns scheme: %q", u.Scheme)
+	}
+
+	return r, nil
+}
+
+// Resolve forwards the raw DNS wire-format query to the configured
+// upstream and returns the raw wire-format response, serving from the TTL
+// cache when possible. replaying must be true during test replay, in which
+// case Resolve never egresses and instead returns a cache hit or
+// ErrDNSCacheMiss. Since replay is normally a separate process from the
+// record run that populated the cache, callers must LoadCache a prior
+// DumpCache before replay starts - otherwise every query replaying sees
+// will miss and come back as ErrDNSCacheMiss.
+func (r *UpstreamDNS) Resolve(ctx context.Context, query []byte, replaying bool) ([]byte, error) {
+	q, err := parseDNSQuestion(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse dns query: %w", err)
+	}
+
+	if resp, ok := r.cacheGet(q); ok {
+		return rekeyDNSResponse(resp, query), nil
+	}
+
+	if replaying {
+		return nil, ErrDNSCacheMiss
+	}
+
+	var resp []byte
+	switch r.scheme {
+	case "udp":
+		resp, err = r.resolveUDP(ctx, query)
+	case "tls":
+		resp, err = r.resolveDoT(ctx, query)
+	case "https":
+		resp, err = r.resolveDoH(ctx, query)
+	default:
+		return nil, fmt.Errorf("unsupported upstream dns scheme: %q", r.scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r.cacheSet(q, resp)
+	return resp, nil
+}
+
+// ErrDNSCacheMiss is returned by Resolve during replay when a query wasn't
+// seen (and therefore cached) at record time - replays must never egress a
+// real DNS lookup.
+var ErrDNSCacheMiss = fmt.Errorf("dns query has no cached response for replay")
+
+func (r *UpstreamDNS) resolveUDP(ctx context.Context, query []byte) ([]byte, error) {
+	conn, err := net.Dial("udp", r.addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial upstream dns %q: %w", r.addr, err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
+	} else if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, fmt.Errorf("failed to write dns query to %q: %w", r.addr, err)
+	}
+
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dns response from %q: %w", r.addr, err)
+	}
+	return buf[:n], nil
+}
+
+func (r *UpstreamDNS) resolveDoT(ctx context.Context, query []byte) ([]byte, error) {
+	dialer := &tls.Dialer{Config: &tls.Config{MinVersion: tls.VersionTLS12}}
+	conn, err := dialer.DialContext(ctx, "tcp", r.addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial upstream dot %q: %w", r.addr, err)
+	}
+	defer conn.Close()
+
+	// Bound the handshake-less write/read that follows by ctx's deadline (or
+	// a conservative default), the same way resolveUDP does - otherwise a
+	// cancelled ctx or an upstream that accepts the connection but never
+	// answers leaves this goroutine and conn blocked in io.ReadFull forever.
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
+	} else if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		return nil, err
+	}
+
+	// DoT frames each message with a 2-byte length prefix, same as classic
+	// DNS-over-TCP (RFC 7858).
+	var framed bytes.Buffer
+	if err := binary.Write(&framed, binary.BigEndian, uint16(len(query))); err != nil {
+		return nil, err
+	}
+	framed.Write(query)
+
+	if _, err := conn.Write(framed.Bytes()); err != nil {
+		return nil, fmt.Errorf("failed to write dot query to %q: %w", r.addr, err)
+	}
+
+	lenBuf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, lenBuf); err != nil {
+		return nil, fmt.Errorf("failed to read dot response length from %q: %w", r.addr, err)
+	}
+
+	resp := make([]byte, binary.BigEndian.Uint16(lenBuf))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, fmt.Errorf("failed to read dot response from %q: %w", r.addr, err)
+	}
+	return resp, nil
+}
+
+func (r *UpstreamDNS) resolveDoH(ctx context.Context, query []byte) ([]byte, error) {
+	// RFC 8484: POST the raw DNS wire query as application/dns-message.
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.addr, bytes.NewReader(query))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build doh request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send doh request to %q: %w", r.addr, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh request to %q returned status %d", r.addr, resp.StatusCode)
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+func (r *UpstreamDNS) cacheGet(q dnsQuestion) ([]byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, ok := r.cache[q]
+	if !ok || time.Now().After(entry.expiresAt) {
+		delete(r.cache, q)
+		return nil, false
+	}
+	return entry.resp, true
+}
+
+func (r *UpstreamDNS) cacheSet(q dnsQuestion, resp []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cache[q] = dnsCacheEntry{
+		resp:      resp,
+		expiresAt: time.Now().Add(minDNSTTL(resp)),
+	}
+}
+
+// DNSCacheRecord is the portable form of one cache entry. Record and replay
+// are ordinarily separate keploy invocations with no shared memory, so
+// Resolve's in-memory cache is useless to a replay run unless something
+// carries its entries across that process boundary - DumpCache/LoadCache
+// are that bridge, meant to be persisted and reloaded alongside the rest of
+// the recorded mocks by whatever owns the mocks file for a test set.
+type DNSCacheRecord struct {
+	Qname     string
+	Qtype     uint16
+	Response  []byte
+	ExpiresAt time.Time
+}
+
+// DumpCache snapshots every live (non-expired) cache entry so the caller
+// can persist it next to the recorded mocks. Call after recording finishes.
+func (r *UpstreamDNS) DumpCache() []DNSCacheRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	records := make([]DNSCacheRecord, 0, len(r.cache))
+	for q, entry := range r.cache {
+		if now.After(entry.expiresAt) {
+			continue
+		}
+		records = append(records, DNSCacheRecord{
+			Qname:     q.qname,
+			Qtype:     q.qtype,
+			Response:  entry.resp,
+			ExpiresAt: entry.expiresAt,
+		})
+	}
+	return records
+}
+
+// LoadCache hydrates the cache from records a prior DumpCache produced.
+// Callers driving replay must call this before the first Resolve so that
+// lookups recorded earlier are served from cache instead of failing with
+// ErrDNSCacheMiss - Resolve itself never reads persisted state.
+func (r *UpstreamDNS) LoadCache(records []DNSCacheRecord) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, rec := range records {
+		r.cache[dnsQuestion{qname: rec.Qname, qtype: rec.Qtype}] = dnsCacheEntry{
+			resp:      rec.Response,
+			expiresAt: rec.ExpiresAt,
+		}
+	}
+}
+
+// parseDNSQuestion extracts the qname/qtype of the first question in a DNS
+// wire-format message. Only the header and question section are parsed -
+// everything else in the cache key comes from these two fields.
+func parseDNSQuestion(msg []byte) (dnsQuestion, error) {
+	const headerLen = 12
+	if len(msg) < headerLen {
+		return dnsQuestion{}, fmt.Errorf("dns message too short: %d bytes", len(msg))
+	}
+
+	qname, off, err := readDNSName(msg, headerLen)
+	if err != nil {
+		return dnsQuestion{}, err
+	}
+	if off+4 > len(msg) {
+		return dnsQuestion{}, fmt.Errorf("dns message truncated before qtype/qclass")
+	}
+
+	return dnsQuestion{
+		qname: qname,
+		qtype: binary.BigEndian.Uint16(msg[off : off+2]),
+	}, nil
+}
+
+// readDNSName decodes a (possibly compressed) name starting at off and
+// returns the name, the offset immediately after it, and any error.
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	start := off
+	jumps := 0
+
+	for {
+		if start >= len(msg) {
+			return "", 0, fmt.Errorf("dns name runs past end of message")
+		}
+		length := int(msg[start])
+
+		if length == 0 {
+			start++
+			break
+		}
+
+		if length&0xC0 == 0xC0 { // compression pointer
+			if jumps > 10 {
+				return "", 0, fmt.Errorf("dns name has too many compression pointers")
+			}
+			if start+1 >= len(msg) {
+				return "", 0, fmt.Errorf("dns name pointer runs past end of message")
+			}
+			ptr := int(binary.BigEndian.Uint16(msg[start:start+2]) &^ 0xC000)
+			if off == start { // only advance the real cursor on the first jump
+				off = start + 2
+			}
+			start = ptr
+			jumps++
+			continue
+		}
+
+		start++
+		if start+length > len(msg) {
+			return "", 0, fmt.Errorf("dns name label runs past end of message")
+		}
+		labels = append(labels, string(msg[start:start+length]))
+		start += length
+		if jumps == 0 {
+			off = start
+		}
+	}
+
+	if jumps == 0 {
+		off = start
+	}
+	return strings.ToLower(strings.Join(labels, ".")), off, nil
+}
+
+// minDNSTTL returns the smallest TTL among resp's answer records, so the
+// cache does not outlive what the upstream promised. It returns a 30-second
+// fallback instead when resp can't be parsed, has no answer records, or its
+// smallest TTL is 0.
+func minDNSTTL(resp []byte) time.Duration {
+	const fallback = 30 * time.Second
+	const headerLen = 12
+
+	if len(resp) < headerLen {
+		return fallback
+	}
+
+	qdCount := int(binary.BigEndian.Uint16(resp[4:6]))
+	anCount := int(binary.BigEndian.Uint16(resp[6:8]))
+
+	off := headerLen
+	for i := 0; i < qdCount; i++ {
+		_, next, err := readDNSName(resp, off)
+		if err != nil || next+4 > len(resp) {
+			return fallback
+		}
+		off = next + 4 // qtype + qclass
+	}
+
+	min := time.Duration(-1)
+	for i := 0; i < anCount; i++ {
+		_, next, err := readDNSName(resp, off)
+		if err != nil || next+10 > len(resp) {
+			return fallback
+		}
+		ttl := time.Duration(binary.BigEndian.Uint32(resp[next+4:next+8])) * time.Second
+		if min == -1 || ttl < min {
+			min = ttl
+		}
+		rdlen := int(binary.BigEndian.Uint16(resp[next+8 : next+10]))
+		off = next + 10 + rdlen
+		if off > len(resp) {
+			return fallback
+		}
+	}
+
+	if min <= 0 {
+		return fallback
+	}
+	return min
+}
+
+// rekeyDNSResponse swaps the cached response's transaction ID for the
+// incoming query's, since a cache hit may be answering a different query
+// than the one that originally populated the cache.
+func rekeyDNSResponse(cached, query []byte) []byte {
+	if len(cached) < 2 || len(query) < 2 {
+		return cached
+	}
+	out := make([]byte, len(cached))
+	copy(out, cached)
+	out[0], out[1] = query[0], query[1]
+	return out
+}
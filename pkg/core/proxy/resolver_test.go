@@ -0,0 +1,255 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+)
+
+// encodeDNSName writes name as a sequence of length-prefixed labels
+// terminated by a zero byte, the wire format readDNSName decodes.
+func encodeDNSName(name string) []byte {
+	var out []byte
+	for _, label := range strings.Split(name, ".") {
+		out = append(out, byte(len(label)))
+		out = append(out, label...)
+	}
+	return append(out, 0)
+}
+
+func TestReadDNSName_Uncompressed(t *testing.T) {
+	header := make([]byte, 12)
+	msg := append(header, encodeDNSName("abc.com")...)
+
+	name, off, err := readDNSName(msg, 12)
+	if err != nil {
+		t.Fatalf("readDNSName returned error: %v", err)
+	}
+	if name != "abc.com" {
+		t.Fatalf("got name %q, want %q", name, "abc.com")
+	}
+	if off != len(msg) {
+		t.Fatalf("got offset %d, want %d", off, len(msg))
+	}
+}
+
+func TestReadDNSName_CompressionPointer(t *testing.T) {
+	header := make([]byte, 12)
+	msg := append(header, encodeDNSName("abc.com")...)
+
+	// A second name, elsewhere in the message, that's just a pointer back
+	// to the first name at offset 12.
+	pointerOff := len(msg)
+	msg = append(msg, 0xC0, 0x0C)
+
+	name, off, err := readDNSName(msg, pointerOff)
+	if err != nil {
+		t.Fatalf("readDNSName returned error: %v", err)
+	}
+	if name != "abc.com" {
+		t.Fatalf("got name %q, want %q", name, "abc.com")
+	}
+	// The cursor must advance past the 2-byte pointer, not past whatever
+	// the pointer jumped into.
+	if off != pointerOff+2 {
+		t.Fatalf("got offset %d, want %d", off, pointerOff+2)
+	}
+}
+
+func TestReadDNSName_CompressionPointerLoop(t *testing.T) {
+	header := make([]byte, 12)
+	// A pointer at offset 12 that points right back at offset 12 would spin
+	// forever without the jump guard.
+	msg := append(header, 0xC0, 0x0C)
+
+	if _, _, err := readDNSName(msg, 12); err == nil {
+		t.Fatal("expected an error for a self-referencing compression pointer, got nil")
+	}
+}
+
+func TestReadDNSName_PointerPastEndOfMessage(t *testing.T) {
+	header := make([]byte, 12)
+	msg := append(header, 0xC0, 0xFF) // points far past the end of msg
+
+	if _, _, err := readDNSName(msg, 12); err == nil {
+		t.Fatal("expected an error for a pointer past the end of the message, got nil")
+	}
+}
+
+func TestParseDNSQuestion(t *testing.T) {
+	header := make([]byte, 12)
+	msg := append(header, encodeDNSName("example.com")...)
+	qtypeClass := make([]byte, 4)
+	binary.BigEndian.PutUint16(qtypeClass[0:2], 1) // qtype A
+	binary.BigEndian.PutUint16(qtypeClass[2:4], 1) // qclass IN
+	msg = append(msg, qtypeClass...)
+
+	q, err := parseDNSQuestion(msg)
+	if err != nil {
+		t.Fatalf("parseDNSQuestion returned error: %v", err)
+	}
+	if q.qname != "example.com" || q.qtype != 1 {
+		t.Fatalf("got %+v, want qname=example.com qtype=1", q)
+	}
+}
+
+func buildDNSQuery(qname string, qtype uint16) []byte {
+	header := make([]byte, 12)
+	header[0], header[1] = 0x12, 0x34 // transaction id
+	binary.BigEndian.PutUint16(header[4:6], 1) // qdcount
+	msg := append(header, encodeDNSName(qname)...)
+	qtypeClass := make([]byte, 4)
+	binary.BigEndian.PutUint16(qtypeClass[0:2], qtype)
+	binary.BigEndian.PutUint16(qtypeClass[2:4], 1) // qclass IN
+	return append(msg, qtypeClass...)
+}
+
+// buildDNSResponse returns a minimal wire-format response to query with one
+// answer record carrying ttl, suitable for exercising cacheSet/minDNSTTL.
+func buildDNSResponse(query []byte, ttl uint32) []byte {
+	resp := make([]byte, len(query))
+	copy(resp, query)
+	binary.BigEndian.PutUint16(resp[6:8], 1) // ancount = 1
+
+	// Answer: a pointer back to the question's name, type A, class IN, ttl,
+	// rdlength 4, rdata 1.2.3.4.
+	answer := []byte{0xC0, 0x0C, 0x00, 0x01, 0x00, 0x01}
+	ttlBuf := make([]byte, 4)
+	binary.BigEndian.PutUint32(ttlBuf, ttl)
+	answer = append(answer, ttlBuf...)
+	answer = append(answer, 0x00, 0x04, 1, 2, 3, 4)
+	return append(resp, answer...)
+}
+
+func TestUpstreamDNS_CacheRoundTrip(t *testing.T) {
+	r, err := NewUpstreamDNS("udp://127.0.0.1:53")
+	if err != nil {
+		t.Fatalf("NewUpstreamDNS returned error: %v", err)
+	}
+
+	query := buildDNSQuery("cached.example.com", 1)
+	resp := buildDNSResponse(query, 300)
+
+	q, err := parseDNSQuestion(query)
+	if err != nil {
+		t.Fatalf("parseDNSQuestion returned error: %v", err)
+	}
+
+	r.cacheSet(q, resp)
+
+	got, ok := r.cacheGet(q)
+	if !ok {
+		t.Fatal("expected a cache hit after cacheSet, got a miss")
+	}
+	if string(got) != string(resp) {
+		t.Fatalf("got cached response %v, want %v", got, resp)
+	}
+}
+
+func TestUpstreamDNS_CacheExpires(t *testing.T) {
+	r, err := NewUpstreamDNS("udp://127.0.0.1:53")
+	if err != nil {
+		t.Fatalf("NewUpstreamDNS returned error: %v", err)
+	}
+
+	query := buildDNSQuery("expired.example.com", 1)
+	q, err := parseDNSQuestion(query)
+	if err != nil {
+		t.Fatalf("parseDNSQuestion returned error: %v", err)
+	}
+
+	// Store an entry that already expired in the past.
+	r.mu.Lock()
+	r.cache[q] = dnsCacheEntry{resp: []byte("stale"), expiresAt: time.Now().Add(-time.Second)}
+	r.mu.Unlock()
+
+	if _, ok := r.cacheGet(q); ok {
+		t.Fatal("expected a cache miss for an expired entry, got a hit")
+	}
+}
+
+func TestUpstreamDNS_Resolve_ReplayMissReturnsErrDNSCacheMiss(t *testing.T) {
+	r, err := NewUpstreamDNS("udp://127.0.0.1:53")
+	if err != nil {
+		t.Fatalf("NewUpstreamDNS returned error: %v", err)
+	}
+
+	query := buildDNSQuery("never-recorded.example.com", 1)
+
+	_, err = r.Resolve(context.Background(), query, true)
+	if err != ErrDNSCacheMiss {
+		t.Fatalf("got error %v, want %v", err, ErrDNSCacheMiss)
+	}
+}
+
+func TestUpstreamDNS_Resolve_ReplayHitServesFromCache(t *testing.T) {
+	r, err := NewUpstreamDNS("udp://127.0.0.1:53")
+	if err != nil {
+		t.Fatalf("NewUpstreamDNS returned error: %v", err)
+	}
+
+	query := buildDNSQuery("recorded.example.com", 1)
+	resp := buildDNSResponse(query, 300)
+	q, err := parseDNSQuestion(query)
+	if err != nil {
+		t.Fatalf("parseDNSQuestion returned error: %v", err)
+	}
+	r.cacheSet(q, resp)
+
+	got, err := r.Resolve(context.Background(), query, true)
+	if err != nil {
+		t.Fatalf("Resolve returned error on a cache hit during replay: %v", err)
+	}
+	if string(got) != string(resp) {
+		t.Fatalf("got %v, want %v", got, resp)
+	}
+}
+
+func TestUpstreamDNS_DumpAndLoadCache(t *testing.T) {
+	recorder, err := NewUpstreamDNS("udp://127.0.0.1:53")
+	if err != nil {
+		t.Fatalf("NewUpstreamDNS returned error: %v", err)
+	}
+
+	query := buildDNSQuery("dump.example.com", 1)
+	resp := buildDNSResponse(query, 300)
+	q, err := parseDNSQuestion(query)
+	if err != nil {
+		t.Fatalf("parseDNSQuestion returned error: %v", err)
+	}
+	recorder.cacheSet(q, resp)
+
+	records := recorder.DumpCache()
+	if len(records) != 1 {
+		t.Fatalf("got %d dumped records, want 1", len(records))
+	}
+
+	// A fresh resolver, standing in for the separate process that drives
+	// replay, must be able to answer the same query purely from the
+	// records DumpCache produced.
+	replayer, err := NewUpstreamDNS("udp://127.0.0.1:53")
+	if err != nil {
+		t.Fatalf("NewUpstreamDNS returned error: %v", err)
+	}
+	replayer.LoadCache(records)
+
+	got, err := replayer.Resolve(context.Background(), query, true)
+	if err != nil {
+		t.Fatalf("Resolve returned error after LoadCache: %v", err)
+	}
+	if string(got) != string(resp) {
+		t.Fatalf("got %v, want %v", got, resp)
+	}
+}
+
+func TestMinDNSTTL(t *testing.T) {
+	query := buildDNSQuery("ttl.example.com", 1)
+	resp := buildDNSResponse(query, 42)
+
+	got := minDNSTTL(resp)
+	if got != 42*time.Second {
+		t.Fatalf("got ttl %v, want %v", got, 42*time.Second)
+	}
+}
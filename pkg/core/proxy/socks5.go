@@ -0,0 +1,264 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"go.keploy.io/server/v2/pkg/core/proxy/util"
+	"go.keploy.io/server/v2/utils"
+	"go.uber.org/zap"
+)
+
+const (
+	socks5Version   = 0x05
+	socks5NoAuth    = 0x00
+	socks5CmdConn   = 0x01
+	socks5AtypIPv4  = 0x01
+	socks5AtypFQDN  = 0x03
+	socks5AtypIPv6  = 0x04
+	socks5Succeeded = 0x00
+)
+
+// ErrUnsupportedSocks5Request is returned when the request's version byte is
+// not 5 or its command is not CONNECT - the app is only ever pointed at us
+// via HTTP_PROXY/ALL_PROXY to open a tunnel, never to relay UDP or BIND. The
+// methods offered in the greeting are not checked: the handshake always
+// selects no-auth.
+var ErrUnsupportedSocks5Request = errors.New("unsupported socks5 request")
+
+// Socks5Handler receives the client conn once the handshake has completed
+// and dest is the "host:port" the client asked to CONNECT to. The handler
+// owns clientConn, and any connection it opens to dest, and must close them.
+type Socks5Handler func(ctx context.Context, clientConn net.Conn, dest string)
+
+// ListenSocks5 starts a SOCKS5 CONNECT listener on addr (port 0 lets the OS
+// pick a free port, e.g. "127.0.0.1:0") and hands every accepted connection to
+// handle after a successful handshake. It returns the bound address so the
+// caller can point the app at it via HTTP_PROXY/ALL_PROXY.
+func ListenSocks5(ctx context.Context, logger *zap.Logger, addr string, handle Socks5Handler) (string, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", fmt.Errorf("failed to start socks5 listener: %w", err)
+	}
+
+	go func() {
+		<-ctx.Done()
+		if err := ln.Close(); err != nil {
+			logger.Debug("failed to close socks5 listener", zap.Error(err))
+		}
+	}()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				logger.Error("failed to accept socks5 connection", zap.Error(err))
+				continue
+			}
+			go acceptSocks5(ctx, logger, conn, handle)
+		}
+	}()
+
+	return ln.Addr().String(), nil
+}
+
+func acceptSocks5(ctx context.Context, logger *zap.Logger, conn net.Conn, handle Socks5Handler) {
+	r := bufio.NewReader(conn)
+
+	dest, err := socks5Handshake(r, conn)
+	if err != nil {
+		logger.Error("socks5 handshake failed", zap.Error(err))
+		if closeErr := conn.Close(); closeErr != nil {
+			logger.Debug("failed to close socks5 client conn", zap.Error(closeErr))
+		}
+		return
+	}
+
+	// bufio.NewReader may have buffered bytes of the tunneled payload past
+	// the handshake in the same read as the CONNECT request (common for
+	// clients that pipeline the request right after opening the tunnel).
+	// Wrap conn so those bytes are served first instead of being dropped.
+	handle(ctx, &bufferedConn{Conn: conn, r: r}, dest)
+}
+
+// bufferedConn serves reads from r (which may hold bytes already consumed
+// from Conn) before falling back to Conn directly, while leaving every
+// other net.Conn method - notably SetReadDeadline - untouched.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// socks5Handshake consumes the greeting, replies with the no-auth method,
+// reads the CONNECT request (ATYP = IPv4, IPv6 or DOMAIN), replies with a
+// success response and returns the requested "host:port".
+func socks5Handshake(r *bufio.Reader, w io.Writer) (string, error) {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return "", fmt.Errorf("failed to read socks5 greeting: %w", err)
+	}
+	if hdr[0] != socks5Version {
+		return "", fmt.Errorf("unsupported socks version: %d", hdr[0])
+	}
+
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return "", fmt.Errorf("failed to read socks5 methods: %w", err)
+	}
+
+	if _, err := w.Write([]byte{socks5Version, socks5NoAuth}); err != nil {
+		return "", fmt.Errorf("failed to write socks5 method selection: %w", err)
+	}
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(r, req); err != nil {
+		return "", fmt.Errorf("failed to read socks5 request: %w", err)
+	}
+	if req[0] != socks5Version || req[1] != socks5CmdConn {
+		return "", ErrUnsupportedSocks5Request
+	}
+
+	host, err := socks5ReadAddr(r, req[3])
+	if err != nil {
+		return "", err
+	}
+
+	portBuf := make([]byte, 2)
+	if _, err := io.ReadFull(r, portBuf); err != nil {
+		return "", fmt.Errorf("failed to read socks5 port: %w", err)
+	}
+	port := binary.BigEndian.Uint16(portBuf)
+
+	reply := []byte{socks5Version, socks5Succeeded, 0x00, socks5AtypIPv4, 0, 0, 0, 0, 0, 0}
+	if _, err := w.Write(reply); err != nil {
+		return "", fmt.Errorf("failed to write socks5 reply: %w", err)
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+func socks5ReadAddr(r io.Reader, atyp byte) (string, error) {
+	switch atyp {
+	case socks5AtypIPv4:
+		addr := make([]byte, 4)
+		if _, err := io.ReadFull(r, addr); err != nil {
+			return "", fmt.Errorf("failed to read socks5 ipv4 address: %w", err)
+		}
+		return net.IP(addr).String(), nil
+	case socks5AtypIPv6:
+		addr := make([]byte, 16)
+		if _, err := io.ReadFull(r, addr); err != nil {
+			return "", fmt.Errorf("failed to read socks5 ipv6 address: %w", err)
+		}
+		return net.IP(addr).String(), nil
+	case socks5AtypFQDN:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(r, l); err != nil {
+			return "", fmt.Errorf("failed to read socks5 domain length: %w", err)
+		}
+		name := make([]byte, l[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", fmt.Errorf("failed to read socks5 domain name: %w", err)
+		}
+		return string(name), nil
+	default:
+		return "", fmt.Errorf("unsupported socks5 address type: %d", atyp)
+	}
+}
+
+// PassThroughSocks5 dials dest and relays traffic between it and clientConn
+// for the lifetime of the tunnel, using the same ReadBuffConn/ReadBytes
+// primitives the eBPF-redirected path's PassThrough is built on. A single
+// request/response exchange would answer only the first message on a
+// keep-alive or pipelined connection and then tear the tunnel down, so this
+// loops request/response pairs until either side closes or errors, or ctx
+// is done (an idle tunnel is not closed by the read timeout) - the same chokepoint a protocol-aware parser (HTTP, Postgres,
+// MySQL, Mongo, ...) would hook into to record mocks once one is
+// registered for dest, rather than a one-shot bare TCP relay.
+func PassThroughSocks5(ctx context.Context, logger *zap.Logger, clientConn net.Conn, dest string, cfg util.ReadConfig) {
+	defer func() {
+		if err := clientConn.Close(); err != nil {
+			logger.Debug("failed to close socks5 client conn", zap.Error(err))
+		}
+	}()
+
+	destConn, err := net.Dial("tcp", dest)
+	if err != nil {
+		logger.Error("failed to dial socks5 destination", zap.String("addr", dest), zap.Error(err))
+		return
+	}
+	defer func() {
+		if err := destConn.Close(); err != nil {
+			logger.Debug("failed to close socks5 dest conn", zap.Error(err))
+		}
+	}()
+
+	reqBuf, err := util.ReadInitialBuf(ctx, logger, clientConn, cfg)
+	if err != nil {
+		logger.Debug("failed to read initial socks5 payload", zap.Error(err))
+		return
+	}
+
+	// One reader goroutine for the whole tunnel, not one per exchange: the
+	// previous exchange's reader is still blocked on destConn.Read when the
+	// next exchange starts, so spawning a fresh one every iteration races
+	// it for whichever bytes the kernel delivers next - the response to
+	// request 2 can land on the abandoned goroutine from request 1 and be
+	// lost on a channel nobody reads anymore.
+	respBufferChannel := make(chan []byte)
+	errChannel := make(chan error)
+	go func() {
+		defer utils.Recover(logger)
+		util.ReadBuffConn(ctx, logger, destConn, respBufferChannel, errChannel, cfg)
+	}()
+
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+
+		if _, err := destConn.Write(reqBuf); err != nil {
+			logger.Error("failed to write socks5 request to destination", zap.String("addr", dest), zap.Error(err))
+			return
+		}
+
+		select {
+		case resp := <-respBufferChannel:
+			if _, err := clientConn.Write(resp); err != nil {
+				logger.Error("failed to write socks5 response to client", zap.Error(err))
+				return
+			}
+		case err := <-errChannel:
+			if netErr, ok := err.(net.Error); !(ok && netErr.Timeout()) {
+				logger.Debug("socks5 destination closed the connection", zap.String("addr", dest), zap.Error(err))
+			}
+			return
+		case <-ctx.Done():
+			return
+		}
+
+		reqBuf, err = util.ReadBytes(ctx, clientConn, cfg)
+		if err != nil {
+			if err != io.EOF {
+				logger.Debug("socks5 client closed the connection", zap.Error(err))
+			}
+			return
+		}
+		if len(reqBuf) == 0 {
+			return
+		}
+	}
+}
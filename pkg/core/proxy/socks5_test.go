@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"go.keploy.io/server/v2/pkg/core/proxy/util"
+	"go.uber.org/zap"
+)
+
+func TestSocks5ReadAddr_IPv4(t *testing.T) {
+	r := bytes.NewReader([]byte{192, 168, 1, 1})
+
+	host, err := socks5ReadAddr(r, socks5AtypIPv4)
+	if err != nil {
+		t.Fatalf("socks5ReadAddr returned error: %v", err)
+	}
+	if host != "192.168.1.1" {
+		t.Fatalf("got host %q, want %q", host, "192.168.1.1")
+	}
+}
+
+func TestSocks5ReadAddr_IPv6(t *testing.T) {
+	ip := net.ParseIP("2001:db8::1")
+	r := bytes.NewReader(ip.To16())
+
+	host, err := socks5ReadAddr(r, socks5AtypIPv6)
+	if err != nil {
+		t.Fatalf("socks5ReadAddr returned error: %v", err)
+	}
+	if host != ip.String() {
+		t.Fatalf("got host %q, want %q", host, ip.String())
+	}
+}
+
+func TestSocks5ReadAddr_FQDN(t *testing.T) {
+	domain := "example.com"
+	var buf bytes.Buffer
+	buf.WriteByte(byte(len(domain)))
+	buf.WriteString(domain)
+
+	host, err := socks5ReadAddr(&buf, socks5AtypFQDN)
+	if err != nil {
+		t.Fatalf("socks5ReadAddr returned error: %v", err)
+	}
+	if host != domain {
+		t.Fatalf("got host %q, want %q", host, domain)
+	}
+}
+
+func TestSocks5ReadAddr_UnsupportedAtyp(t *testing.T) {
+	r := bytes.NewReader(nil)
+	if _, err := socks5ReadAddr(r, 0x7F); err == nil {
+		t.Fatal("expected an error for an unsupported address type, got nil")
+	}
+}
+
+// socks5Request builds a client-side greeting + CONNECT request for the
+// given ATYP/address bytes/port, as socks5Handshake expects to read them.
+func socks5Request(atyp byte, addr []byte, port uint16) []byte {
+	var buf bytes.Buffer
+	buf.Write([]byte{socks5Version, 1, socks5NoAuth}) // greeting: 1 method, no-auth
+	buf.Write([]byte{socks5Version, socks5CmdConn, 0x00, atyp})
+	buf.Write(addr)
+	portBuf := make([]byte, 2)
+	binary.BigEndian.PutUint16(portBuf, port)
+	buf.Write(portBuf)
+	return buf.Bytes()
+}
+
+func TestSocks5Handshake_IPv4(t *testing.T) {
+	req := socks5Request(socks5AtypIPv4, []byte{10, 0, 0, 1}, 8080)
+
+	var reply bytes.Buffer
+	dest, err := socks5Handshake(bufio.NewReader(bytes.NewReader(req)), &reply)
+	if err != nil {
+		t.Fatalf("socks5Handshake returned error: %v", err)
+	}
+	if dest != "10.0.0.1:8080" {
+		t.Fatalf("got dest %q, want %q", dest, "10.0.0.1:8080")
+	}
+
+	wantReply := []byte{socks5Version, socks5Succeeded, 0x00, socks5AtypIPv4, 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(reply.Bytes()[len(reply.Bytes())-len(wantReply):], wantReply) {
+		t.Fatalf("got reply suffix %v, want %v", reply.Bytes(), wantReply)
+	}
+}
+
+func TestSocks5Handshake_FQDN(t *testing.T) {
+	domain := []byte("example.com")
+	addr := append([]byte{byte(len(domain))}, domain...)
+	req := socks5Request(socks5AtypFQDN, addr, 443)
+
+	dest, err := socks5Handshake(bufio.NewReader(bytes.NewReader(req)), &bytes.Buffer{})
+	if err != nil {
+		t.Fatalf("socks5Handshake returned error: %v", err)
+	}
+	if dest != "example.com:443" {
+		t.Fatalf("got dest %q, want %q", dest, "example.com:443")
+	}
+}
+
+func TestSocks5Handshake_UnsupportedVersion(t *testing.T) {
+	req := []byte{0x04, 1, socks5NoAuth}
+	if _, err := socks5Handshake(bufio.NewReader(bytes.NewReader(req)), &bytes.Buffer{}); err == nil {
+		t.Fatal("expected an error for an unsupported socks version, got nil")
+	}
+}
+
+func TestSocks5Handshake_UnsupportedCommand(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write([]byte{socks5Version, 1, socks5NoAuth})
+	buf.Write([]byte{socks5Version, 0x02, 0x00, socks5AtypIPv4}) // BIND, not CONNECT
+	buf.Write([]byte{127, 0, 0, 1, 0, 80})
+
+	_, err := socks5Handshake(bufio.NewReader(bytes.NewReader(buf.Bytes())), &bytes.Buffer{})
+	if err != ErrUnsupportedSocks5Request {
+		t.Fatalf("got error %v, want %v", err, ErrUnsupportedSocks5Request)
+	}
+}
+
+// TestPassThroughSocks5_KeepAliveMultipleExchanges drives two sequential
+// request/response pairs over one tunnel. Before the single long-lived
+// reader goroutine fix, the second exchange's response could be delivered
+// to the first exchange's abandoned reader goroutine and the test would
+// hang waiting for a response that already arrived on the wrong channel.
+func TestPassThroughSocks5_KeepAliveMultipleExchanges(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start echo listener: %v", err)
+	}
+	defer func() { _ = ln.Close() }()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+
+		buf := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			if n > 0 {
+				if _, werr := conn.Write(buf[:n]); werr != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	clientConn, testClient := net.Pipe()
+	cfg := util.ReadConfig{IdleTimeout: 2 * time.Second, MaxMessageSize: 1 << 20}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		PassThroughSocks5(context.Background(), zap.NewNop(), clientConn, ln.Addr().String(), cfg)
+	}()
+
+	for i, msg := range []string{"first request", "second request"} {
+		if _, err := testClient.Write([]byte(msg)); err != nil {
+			t.Fatalf("exchange %d: write failed: %v", i, err)
+		}
+
+		resp := make([]byte, len(msg))
+		if _, err := io.ReadFull(testClient, resp); err != nil {
+			t.Fatalf("exchange %d: read failed: %v", i, err)
+		}
+		if string(resp) != msg {
+			t.Fatalf("exchange %d: got %q, want %q", i, resp, msg)
+		}
+	}
+
+	if err := testClient.Close(); err != nil {
+		t.Fatalf("failed to close test client conn: %v", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("PassThroughSocks5 did not return after the client closed the tunnel")
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -30,8 +31,58 @@ func GetNextID() int64 {
 	return atomic.AddInt64(&idCounter, 1)
 }
 
+// ErrMessageTooLarge is returned when a single message would grow past
+// ReadConfig.MaxMessageSize, e.g. a Postgres COPY or MySQL LOAD DATA stream
+// with no natural frame boundary.
+var ErrMessageTooLarge = errors.New("message exceeds the maximum allowed size")
+
+// Framer lets a protocol parser (MySQL's 3-byte length header, Postgres'
+// 4-byte length, MongoDB's message header, ...) tell ReadFramedBytes exactly
+// how many bytes its next message needs, instead of the caller reading
+// until the connection goes idle. Bytes read past the current frame (e.g.
+// a second message pipelined right behind the first in the same socket
+// Read) are kept and handed to the next ReadFramedBytes/ReadRequiredBytes
+// call on the same reader rather than discarded - see pipelinedLeftovers.
+type Framer interface {
+	// NextFrameLen inspects the bytes read so far and returns the total
+	// number of bytes the frame needs. It returns (-1, nil) if more bytes
+	// are required before the frame length can be determined.
+	NextFrameLen(prefix []byte) (int, error)
+}
+
+// ReadConfig bounds how long ReadBytes/ReadRequiredBytes wait for more data
+// once a message has started arriving (before the first byte they wait
+// without limit) and how large a single message is allowed to grow.
+type ReadConfig struct {
+	IdleTimeout    time.Duration
+	MaxMessageSize int
+}
+
+// DefaultReadConfig is used whenever a caller leaves IdleTimeout or
+// MaxMessageSize unset.
+var DefaultReadConfig = ReadConfig{
+	IdleTimeout:    30 * time.Second,
+	MaxMessageSize: 64 * 1024 * 1024, // 64MiB
+}
+
+// bufPool reuses the scratch buffers backing ReadBytes/ReadRequiredBytes so
+// long-lived streams don't keep re-growing a fresh []byte on every read.
+var bufPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+func (cfg ReadConfig) withDefaults() ReadConfig {
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = DefaultReadConfig.IdleTimeout
+	}
+	if cfg.MaxMessageSize <= 0 {
+		cfg.MaxMessageSize = DefaultReadConfig.MaxMessageSize
+	}
+	return cfg
+}
+
 // ReadBuffConn is used to read the buffer from the connection
-func ReadBuffConn(ctx context.Context, logger *zap.Logger, conn net.Conn, bufferChannel chan []byte, errChannel chan error) {
+func ReadBuffConn(ctx context.Context, logger *zap.Logger, conn net.Conn, bufferChannel chan []byte, errChannel chan error, cfg ReadConfig) {
 	for {
 		select {
 		case <-ctx.Done():
@@ -40,7 +91,7 @@ func ReadBuffConn(ctx context.Context, logger *zap.Logger, conn net.Conn, buffer
 			if conn == nil {
 				logger.Debug("the conn is nil")
 			}
-			buffer, err := ReadBytes(ctx, conn)
+			buffer, err := ReadBytes(ctx, conn, cfg)
 			if err != nil {
 				logger.Error("failed to read the packet message in proxy", zap.Error(err))
 				errChannel <- err
@@ -51,10 +102,10 @@ func ReadBuffConn(ctx context.Context, logger *zap.Logger, conn net.Conn, buffer
 	}
 }
 
-func ReadInitialBuf(ctx context.Context, logger *zap.Logger, conn net.Conn) ([]byte, error) {
+func ReadInitialBuf(ctx context.Context, logger *zap.Logger, conn net.Conn, cfg ReadConfig) ([]byte, error) {
 	readErr := errors.New("failed to read the initial request buffer")
 
-	initialBuf, err := ReadBytes(ctx, conn)
+	initialBuf, err := ReadBytes(ctx, conn, cfg)
 	if err != nil && err != io.EOF {
 		logger.Error("failed to read the request message in proxy", zap.Error(err))
 		return nil, readErr
@@ -73,90 +124,132 @@ func ReadInitialBuf(ctx context.Context, logger *zap.Logger, conn net.Conn) ([]b
 	return initialBuf, nil
 }
 
-// ReadBytes function is utilized to read the complete message from the reader until the end of the file (EOF).
-// It returns the content as a byte array.
-func ReadBytes(ctx context.Context, reader io.Reader) ([]byte, error) {
-	var buffer []byte
-	const maxEmptyReads = 5
-	emptyReads := 0
+// ReadBytes reads a single message from reader. The message ends at the
+// first Read that returns fewer bytes than the 4096-byte scratch chunk, or
+// when a read deadline of cfg.IdleTimeout expires after some data has
+// arrived. A timeout before any data has arrived keeps waiting; any other
+// error, io.EOF included, is returned as-is with whatever was read.
+func ReadBytes(ctx context.Context, reader io.Reader, cfg ReadConfig) ([]byte, error) {
+	return readFramed(ctx, reader, cfg, nil)
+}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return buffer, nil
-		default:
-			buf := make([]byte, 1024)
-			n, err := reader.Read(buf)
+// ReadRequiredBytes reads numBytes from reader. If a read deadline of
+// cfg.IdleTimeout expires after some but not all of them have arrived, it
+// returns the bytes read so far with a nil error.
+func ReadRequiredBytes(ctx context.Context, reader io.Reader, numBytes int, cfg ReadConfig) ([]byte, error) {
+	return readFramed(ctx, reader, cfg, fixedFramer{n: numBytes})
+}
 
-			if n > 0 {
-				buffer = append(buffer, buf[:n]...)
-				emptyReads = 0 // reset the counter because we got some data
-			}
+// ReadFramedBytes reads until framer reports the frame is complete, pulling
+// exactly the bytes a protocol parser asked for rather than racing the idle
+// timeout. If a read deadline of cfg.IdleTimeout expires (or ctx is done)
+// after part of a frame has arrived, the partial frame is returned with a
+// nil error.
+func ReadFramedBytes(ctx context.Context, reader io.Reader, cfg ReadConfig, framer Framer) ([]byte, error) {
+	return readFramed(ctx, reader, cfg, framer)
+}
 
-			if err != nil {
-				if err == io.EOF {
-					emptyReads++
-					if emptyReads >= maxEmptyReads {
-						return buffer, err // multiple EOFs in a row, probably a true EOF
-					}
-					time.Sleep(time.Millisecond * 100) // sleep before trying again
-					continue
-				}
-				return buffer, err
-			}
+// fixedFramer completes a frame once exactly n bytes have been read.
+type fixedFramer struct{ n int }
+
+func (f fixedFramer) NextFrameLen([]byte) (int, error) { return f.n, nil }
+
+// pipelinedLeftovers holds, per reader, the bytes a framer-driven readFramed
+// call already pulled off the wire but didn't hand back because they belong
+// to the next frame (e.g. a second pipelined MySQL/Postgres message that
+// arrived in the same conn.Read as the first). Without this, those bytes
+// would vanish when the pooled buffer backing the call that read them is
+// reset and reused - the next ReadFramedBytes/ReadRequiredBytes call on the
+// same reader would then hang waiting for bytes that already arrived.
+var pipelinedLeftovers sync.Map // map[io.Reader][]byte
+
+// DiscardPipelined drops any leftover pipelined bytes recorded for reader.
+// Callers that are done reading from a connection (e.g. on close) should
+// call this so pipelinedLeftovers doesn't keep the reader - and whatever
+// bytes it has - reachable forever.
+func DiscardPipelined(reader io.Reader) {
+	pipelinedLeftovers.Delete(reader)
+}
 
-			if n < len(buf) {
-				return buffer, nil
-			}
-		}
+func readFramed(ctx context.Context, reader io.Reader, cfg ReadConfig, framer Framer) ([]byte, error) {
+	cfg = cfg.withDefaults()
+
+	deadlineConn, hasDeadline := reader.(net.Conn)
+
+	buf, _ := bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufPool.Put(buf)
+
+	if leftover, ok := pipelinedLeftovers.LoadAndDelete(reader); ok {
+		buf.Write(leftover.([]byte))
 	}
-}
 
-// ReadRequiredBytes ReadBytes function is utilized to read the complete message from the reader until the end of the file (EOF).
-// It returns the content as a byte array.
-func ReadRequiredBytes(ctx context.Context, reader io.Reader, numBytes int) ([]byte, error) {
-	var buffer []byte
-	const maxEmptyReads = 5
-	emptyReads := 0
+	chunk := make([]byte, 4096)
 
 	for {
 		select {
 		case <-ctx.Done():
-			return buffer, nil
+			return cloneBuf(buf), nil
 		default:
-			buf := make([]byte, numBytes)
+		}
 
-			n, err := reader.Read(buf)
+		if framer != nil {
+			need, ferr := framer.NextFrameLen(buf.Bytes())
+			if ferr != nil {
+				return nil, ferr
+			}
+			if need >= 0 && buf.Len() >= need {
+				out := make([]byte, need)
+				copy(out, buf.Bytes()[:need])
+				if buf.Len() > need {
+					leftover := make([]byte, buf.Len()-need)
+					copy(leftover, buf.Bytes()[need:])
+					pipelinedLeftovers.Store(reader, leftover)
+				}
+				return out, nil
+			}
+		}
 
-			if n == numBytes {
-				buffer = append(buffer, buf...)
-				return buffer, nil
+		if hasDeadline {
+			if err := deadlineConn.SetReadDeadline(time.Now().Add(cfg.IdleTimeout)); err != nil {
+				return nil, err
 			}
+		}
 
-			if n > 0 {
-				buffer = append(buffer, buf[:n]...)
-				numBytes = numBytes - n
-				emptyReads = 0 // reset the counter because we got some data
+		n, err := reader.Read(chunk)
+		if n > 0 {
+			buf.Write(chunk[:n])
+			if buf.Len() > cfg.MaxMessageSize {
+				return nil, ErrMessageTooLarge
 			}
+		}
 
-			if err != nil {
-				if err == io.EOF {
-					emptyReads++
-					if emptyReads >= maxEmptyReads {
-						return buffer, err // multiple EOFs in a row, probably a true EOF
-					}
-					time.Sleep(time.Millisecond * 100) // sleep before trying again
-					continue
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				if buf.Len() == 0 {
+					continue // nothing read yet, keep waiting for more data
 				}
-				return buffer, err
+				return cloneBuf(buf), nil
 			}
+			return cloneBuf(buf), err
+		}
+
+		if framer == nil && n < len(chunk) {
+			return cloneBuf(buf), nil
 		}
 	}
 }
 
+func cloneBuf(buf *bytes.Buffer) []byte {
+	out := make([]byte, buf.Len())
+	copy(out, buf.Bytes())
+	return out
+}
+
 // PassThrough function is used to pass the network traffic to the destination connection.
 // It also closes the destination connection if the function returns an error.
-func PassThrough(ctx context.Context, logger *zap.Logger, clientConn, destConn net.Conn, requestBuffer [][]byte) ([]byte, error) {
+func PassThrough(ctx context.Context, logger *zap.Logger, clientConn, destConn net.Conn, requestBuffer [][]byte, cfg ReadConfig) ([]byte, error) {
 
 	if destConn == nil {
 		return nil, errors.New("failed to pass network traffic to the destination conn")
@@ -184,7 +277,7 @@ func PassThrough(ctx context.Context, logger *zap.Logger, clientConn, destConn n
 
 	go func() {
 		defer utils.Recover(logger)
-		ReadBuffConn(ctx, logger, destConn, destBufferChannel, errChannel)
+		ReadBuffConn(ctx, logger, destConn, destBufferChannel, errChannel, cfg)
 	}()
 
 	select {
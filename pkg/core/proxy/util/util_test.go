@@ -0,0 +1,113 @@
+package util
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func testReadConfig() ReadConfig {
+	return ReadConfig{IdleTimeout: 2 * time.Second, MaxMessageSize: 1 << 20}
+}
+
+// TestReadRequiredBytes_PipelinedBytesCarryOverToNextCall pins the bug where
+// bytes read past the requested frame (a second message pipelined right
+// behind the first in the same socket Read) used to be silently dropped
+// when the pooled buffer backing the call was reset and reused.
+func TestReadRequiredBytes_PipelinedBytesCarryOverToNextCall(t *testing.T) {
+	server, client := net.Pipe()
+	defer func() { _ = server.Close() }()
+	defer func() { _ = client.Close() }()
+
+	go func() {
+		// Both 5-byte frames arrive in a single underlying Read.
+		_, _ = client.Write([]byte("HELLOWORLD"))
+	}()
+
+	ctx := context.Background()
+	cfg := testReadConfig()
+
+	first, err := ReadRequiredBytes(ctx, server, 5, cfg)
+	if err != nil {
+		t.Fatalf("first ReadRequiredBytes returned error: %v", err)
+	}
+	if string(first) != "HELLO" {
+		t.Fatalf("got first frame %q, want %q", first, "HELLO")
+	}
+
+	second, err := ReadRequiredBytes(ctx, server, 5, cfg)
+	if err != nil {
+		t.Fatalf("second ReadRequiredBytes returned error: %v", err)
+	}
+	if string(second) != "WORLD" {
+		t.Fatalf("got second frame %q, want %q (pipelined bytes were dropped)", second, "WORLD")
+	}
+}
+
+// lengthPrefixedFramer treats the first byte of prefix as the length of the
+// rest of the frame, a stand-in for a real protocol's length-prefixed
+// framing (MySQL, Postgres, MongoDB, ...).
+type lengthPrefixedFramer struct{}
+
+func (lengthPrefixedFramer) NextFrameLen(prefix []byte) (int, error) {
+	if len(prefix) < 1 {
+		return -1, nil
+	}
+	return 1 + int(prefix[0]), nil
+}
+
+func TestReadFramedBytes_LengthPrefixedFrame(t *testing.T) {
+	server, client := net.Pipe()
+	defer func() { _ = server.Close() }()
+	defer func() { _ = client.Close() }()
+
+	go func() {
+		_, _ = client.Write([]byte{3, 'a', 'b', 'c'})
+	}()
+
+	frame, err := ReadFramedBytes(context.Background(), server, testReadConfig(), lengthPrefixedFramer{})
+	if err != nil {
+		t.Fatalf("ReadFramedBytes returned error: %v", err)
+	}
+	if string(frame) != string([]byte{3, 'a', 'b', 'c'}) {
+		t.Fatalf("got frame %v, want %v", frame, []byte{3, 'a', 'b', 'c'})
+	}
+}
+
+func TestReadRequiredBytes_MaxMessageSizeGuard(t *testing.T) {
+	server, client := net.Pipe()
+	defer func() { _ = server.Close() }()
+	defer func() { _ = client.Close() }()
+
+	go func() {
+		_, _ = client.Write(make([]byte, 64))
+	}()
+
+	cfg := ReadConfig{IdleTimeout: 2 * time.Second, MaxMessageSize: 8}
+	_, err := ReadRequiredBytes(context.Background(), server, 64, cfg)
+	if err != ErrMessageTooLarge {
+		t.Fatalf("got error %v, want %v", err, ErrMessageTooLarge)
+	}
+}
+
+func TestReadRequiredBytes_IdleTimeoutReturnsWhateverWasRead(t *testing.T) {
+	server, client := net.Pipe()
+	defer func() { _ = server.Close() }()
+	defer func() { _ = client.Close() }()
+
+	go func() {
+		_, _ = client.Write([]byte("partial"))
+	}()
+
+	cfg := ReadConfig{IdleTimeout: 100 * time.Millisecond, MaxMessageSize: 1 << 20}
+	// Ask for more bytes than will ever arrive; the idle timeout should
+	// return what was read instead of blocking forever.
+	got, err := ReadRequiredBytes(context.Background(), server, 64, cfg)
+	if err != nil {
+		t.Fatalf("ReadRequiredBytes returned error: %v", err)
+	}
+	if string(got) != "partial" {
+		t.Fatalf("got %q, want %q", got, "partial")
+	}
+}